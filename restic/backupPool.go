@@ -0,0 +1,99 @@
+package restic
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"git.vshn.net/vshn/wrestic/output"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BackupJob describes a single restic invocation to run as part of a
+// backup pool, e.g. one PVC/pod pair.
+type BackupJob struct {
+	Args []string
+	// PVC identifies this job for ToProm's metric labels. Required
+	// whenever more than one job may run concurrently against the same
+	// repository, otherwise their collectors collide when gathered
+	// together by PushMetrics.
+	PVC     string
+	Options commandOptions
+}
+
+// CommandResult is everything a caller needs from one finished BackupJob,
+// without reaching back into the genericCommand that produced it.
+type CommandResult struct {
+	StdOut      []string
+	StdErr      []string
+	Error       error
+	Prom        []prometheus.Collector
+	WebhookData []output.JsonMarshaller
+}
+
+// RunBackupPool runs jobs over a bounded pool of workers, sized by
+// WRESTIC_BACKUP_CONCURRENCY (default 1, preserving today's serial
+// behaviour). Each worker owns its own genericCommand. Results are returned
+// in the same order as jobs, regardless of which worker finishes first, so
+// callers can build a deterministic webhook body.
+func RunBackupPool(commandState *commandState, jobs []BackupJob) []CommandResult {
+	return runIndexedPool(backupConcurrency(), len(jobs), func(i int) CommandResult {
+		g := newGenericCommand(commandState)
+		options := jobs[i].Options
+		options.pvc = jobs[i].PVC
+		g.exec(jobs[i].Args, options)
+		return CommandResult{
+			StdOut:      g.GetStdOut(),
+			StdErr:      g.GetStdErrOut(),
+			Error:       g.GetError(),
+			Prom:        g.ToProm(),
+			WebhookData: g.GetWebhookData(),
+		}
+	})
+}
+
+// runIndexedPool runs worker(i) for every i in [0,n) across a bounded pool
+// of concurrency goroutines (at least 1), returning results in index order
+// regardless of which worker finishes first.
+func runIndexedPool(concurrency, n int, worker func(index int) CommandResult) []CommandResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]CommandResult, n)
+	indices := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = worker(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return results
+}
+
+// backupConcurrency reads WRESTIC_BACKUP_CONCURRENCY, defaulting to 1 so
+// existing deployments keep running backups serially unless they opt in.
+func backupConcurrency() int {
+	v := os.Getenv("WRESTIC_BACKUP_CONCURRENCY")
+	if v == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		fmt.Printf("invalid WRESTIC_BACKUP_CONCURRENCY %q, defaulting to 1\n", v)
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,71 @@
+package restic
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunIndexedPoolPreservesOrder(t *testing.T) {
+	const n = 20
+
+	var calls int32
+	results := runIndexedPool(4, n, func(i int) CommandResult {
+		// Vary how long each worker takes so completion order differs
+		// from index order, the case that would expose a result being
+		// written to the wrong slot.
+		time.Sleep(time.Duration(n-i) * time.Millisecond)
+		atomic.AddInt32(&calls, 1)
+		return CommandResult{StdOut: []string{strconv.Itoa(i)}}
+	})
+
+	if int(calls) != n {
+		t.Fatalf("worker called %d times, want %d", calls, n)
+	}
+	if len(results) != n {
+		t.Fatalf("got %d results, want %d", len(results), n)
+	}
+	for i, r := range results {
+		want := strconv.Itoa(i)
+		if len(r.StdOut) != 1 || r.StdOut[0] != want {
+			t.Errorf("results[%d] = %v, want [%s]", i, r.StdOut, want)
+		}
+	}
+}
+
+func TestRunIndexedPoolConcurrencyAtLeastOne(t *testing.T) {
+	for _, concurrency := range []int{0, -1} {
+		t.Run(strconv.Itoa(concurrency), func(t *testing.T) {
+			results := runIndexedPool(concurrency, 3, func(i int) CommandResult {
+				return CommandResult{StdOut: []string{strconv.Itoa(i)}}
+			})
+			if len(results) != 3 {
+				t.Fatalf("got %d results, want 3", len(results))
+			}
+		})
+	}
+}
+
+func TestBackupConcurrency(t *testing.T) {
+	cases := []struct {
+		name string
+		env  string
+		want int
+	}{
+		{"unset defaults to 1", "", 1},
+		{"valid value is honoured", "4", 4},
+		{"zero falls back to 1", "0", 1},
+		{"negative falls back to 1", "-2", 1},
+		{"non-numeric falls back to 1", "nope", 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WRESTIC_BACKUP_CONCURRENCY", tc.env)
+			if got := backupConcurrency(); got != tc.want {
+				t.Errorf("backupConcurrency() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package restic
+
+import (
+	"sync"
+)
+
+// commandState tracks every genericCommand that is currently executing, so
+// that a termination request reaching the wrestic process (e.g. its pod
+// being deleted while a backup pool is running several restic children at
+// once) can cancel all of them through the same SIGINT-then-grace-then-
+// SIGKILL shutdown as a per-subcommand timeout, instead of signalling the
+// restic process directly and skipping the grace period.
+type commandState struct {
+	mutex   sync.Mutex
+	running map[*genericCommand]struct{}
+}
+
+func newCommandState() *commandState {
+	return &commandState{
+		running: make(map[*genericCommand]struct{}),
+	}
+}
+
+// setRunning registers g as currently running.
+func (c *commandState) setRunning(g *genericCommand) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.running[g] = struct{}{}
+}
+
+// setDone unregisters g once it has finished running.
+func (c *commandState) setDone(g *genericCommand) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.running, g)
+}
+
+// CancelAll cancels the context of every currently-running command. Each
+// one reacts through its own watchContext goroutine: SIGINT first so restic
+// finalizes cleanly, then SIGKILL after gracePeriod if it hasn't exited.
+func (c *commandState) CancelAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for g := range c.running {
+		g.cancel()
+	}
+}
@@ -0,0 +1,95 @@
+package restic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// EventType identifies which kind of structured event a sink receives.
+type EventType string
+
+const (
+	EventCommandStarted  EventType = "CommandStarted"
+	EventProgressUpdate  EventType = "ProgressUpdate"
+	EventSnapshotCreated EventType = "SnapshotCreated"
+	EventCommandFinished EventType = "CommandFinished"
+	EventPruneRemoved    EventType = "PruneRemoved"
+)
+
+// Event is a structured notification emitted while a restic
+// command runs, for sinks that want realtime updates instead of waiting for
+// GetWebhookData at the end of the run.
+type Event struct {
+	Type       EventType         `json:"type"`
+	Command    string            `json:"command"`
+	Repository string            `json:"repository"`
+	Progress   *ProgressSnapshot `json:"progress,omitempty"`
+	Summary    *BackupSummary    `json:"summary,omitempty"`
+	SnapshotID string            `json:"snapshot_id,omitempty"`
+	Removed    []string          `json:"removed,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// emitEvent sends evt on sink, a no-op if sink is nil so callers don't need
+// to guard every call site.
+func emitEvent(sink chan<- Event, evt Event) {
+	if sink == nil {
+		return
+	}
+	sink <- evt
+}
+
+// StdoutEventSink writes every event from events to stdout as a single line
+// of JSON, for kubectl logs-based monitoring. It blocks until events is
+// closed, so callers should run it in its own goroutine.
+func StdoutEventSink(events <-chan Event) {
+	for evt := range events {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println(string(line))
+	}
+}
+
+// HTTPEventSink streams every event from events to url as newline-delimited
+// JSON over a single chunked-transfer POST request. It blocks until events
+// is closed or the request fails, so callers should run it in its own
+// goroutine.
+func HTTPEventSink(url string, events <-chan Event) error {
+	pr, pw := io.Pipe()
+
+	go func() {
+		encoder := json.NewEncoder(pw)
+		var encodeErr error
+		for evt := range events {
+			if encodeErr != nil {
+				// Already failed: keep draining events so producers
+				// blocked on an unbuffered send to this sink (e.g.
+				// genericCommand.execContext) don't wedge forever, we
+				// just stop trying to encode them.
+				continue
+			}
+			if err := encoder.Encode(evt); err != nil {
+				encodeErr = err
+				pw.CloseWithError(err)
+			}
+		}
+		if encodeErr == nil {
+			pw.Close()
+		}
+	}()
+
+	resp, err := http.Post(url, "application/x-ndjson", pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event sink %s returned status %s", url, resp.Status)
+	}
+	return nil
+}
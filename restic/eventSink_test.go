@@ -0,0 +1,56 @@
+package restic
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHTTPEventSinkDrainsAfterEncodeFailure guards against the deadlock
+// fixed in 5468396: once one event fails to encode, the sink goroutine must
+// keep draining events instead of returning, otherwise a producer blocked
+// on an unbuffered send (e.g. genericCommand.execContext's emitEvent) would
+// hang forever.
+func TestHTTPEventSinkDrainsAfterEncodeFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	events := make(chan Event)
+	done := make(chan error, 1)
+	go func() {
+		done <- HTTPEventSink(srv.URL, events)
+	}()
+
+	// NaN can't be marshalled to JSON, so this forces the encode failure.
+	events <- Event{Type: EventProgressUpdate, Progress: &ProgressSnapshot{PercentDone: math.NaN()}}
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			events <- Event{Type: EventCommandFinished}
+		}
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("producer blocked sending events after an encode failure; sink did not drain")
+	}
+
+	close(events)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("HTTPEventSink() error = nil, want the encode failure to surface as a request error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("HTTPEventSink did not return after events was closed")
+	}
+}
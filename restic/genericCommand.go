@@ -2,18 +2,34 @@ package restic
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"sync"
+	"time"
 
 	"git.vshn.net/vshn/wrestic/kubernetes"
 	"git.vshn.net/vshn/wrestic/output"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// gracePeriod is how long a cancelled command is given to shut down cleanly
+// after SIGINT before execContext escalates to SIGKILL.
+const gracePeriod = 30 * time.Second
+
+// subcommandTimeoutEnv maps a restic subcommand (the first element of args)
+// to the environment variable that overrides its default timeout.
+var subcommandTimeoutEnv = map[string]string{
+	"backup": "WRESTIC_BACKUP_TIMEOUT",
+	"prune":  "WRESTIC_PRUNE_TIMEOUT",
+	"check":  "WRESTIC_CHECK_TIMEOUT",
+	"forget": "WRESTIC_FORGET_TIMEOUT",
+}
+
 type genericCommand struct {
 	errorMessage      error
 	stdOut, stdErrOut []string
@@ -23,6 +39,27 @@ type genericCommand struct {
 	// commandState holds the global state what command is currently running
 	commandState *commandState
 	mutex        *sync.Mutex
+	// progress holds the most recent status reported by restic's --json
+	// output, updated while the command is running
+	progress ProgressSnapshot
+	// summary holds the final "summary" message of a restic --json backup,
+	// nil if the command never finished or wasn't run in progress mode
+	summary *BackupSummary
+	// commandName, repository and pvc identify this invocation for the
+	// metrics built by ToProm, e.g. "backup" against "s3:example.com/bucket"
+	// for PVC "webapp-data". pvc is empty for commands that aren't tied to
+	// a single PVC (check, prune, ...), but is always present as a label so
+	// every invocation of ToProm shares the same label set.
+	commandName, repository, pvc string
+	// startTime, endTime and exitCode track the lifetime of command, set
+	// once the process has started resp. exited
+	startTime, endTime time.Time
+	exitCode           int
+	// cancel cancels the context execContext is running under, letting
+	// commandState.CancelAll trigger the same SIGINT-then-grace-then-
+	// SIGKILL shutdown as a per-subcommand timeout instead of signalling
+	// the process directly
+	cancel context.CancelFunc
 }
 
 type commandOptions struct {
@@ -33,6 +70,76 @@ type commandOptions struct {
 	// not all subcommands have realtime output though, so it's not mandatory
 	// to set it.
 	output chan string
+	// progress makes exec append --json to the restic argv and parse stdout
+	// as a stream of restic JSON messages instead of plain text
+	progress bool
+	// sink, if set, receives a structured Event as soon as it happens
+	// instead of callers having to wait for GetWebhookData at the end of
+	// the run. Attaching a sink also stops collectOutput from buffering
+	// the whole of stdout in memory.
+	sink chan<- Event
+	// pvc identifies the PVC/pod this invocation is backing up. It's only
+	// needed to disambiguate ToProm's metrics when several commandOptions
+	// run concurrently against the same repository (see RunBackupPool);
+	// a single serial command can leave it empty.
+	pvc string
+}
+
+// ProgressSnapshot is a point-in-time view of a running restic command,
+// parsed from its "status" JSON messages. For a --stdin command BytesDone is
+// also updated by countingReader as the stdin pump copies data.
+type ProgressSnapshot struct {
+	PercentDone  float64
+	FilesDone    int
+	TotalBytes   int64
+	BytesDone    int64
+	CurrentFiles []string
+	ETASeconds   int64
+}
+
+// BackupSummary is restic's final "summary" JSON message for a backup run.
+type BackupSummary struct {
+	FilesNew            int    `json:"files_new"`
+	FilesChanged        int    `json:"files_changed"`
+	FilesUnmodified     int    `json:"files_unmodified"`
+	DataAdded           int64  `json:"data_added"`
+	TotalFilesProcessed int    `json:"total_files_processed"`
+	TotalBytesProcessed int64  `json:"total_bytes_processed"`
+	SnapshotID          string `json:"snapshot_id"`
+}
+
+// MarshalJSON implements output.JsonMarshaller so the summary can be sent
+// to the webhook endpoint as-is.
+func (b *BackupSummary) MarshalJSON() ([]byte, error) {
+	type summary BackupSummary
+	return json.Marshal((*summary)(b))
+}
+
+// resticMessage is the union of the fields restic's --json mode can emit
+// across its "status", "summary", "error" and "verbose_status" messages.
+// Unknown message types and unparsable lines are ignored by the caller.
+type resticMessage struct {
+	MessageType string `json:"message_type"`
+
+	// status
+	PercentDone      float64  `json:"percent_done"`
+	FilesDone        int      `json:"files_done"`
+	TotalBytes       int64    `json:"total_bytes"`
+	BytesDone        int64    `json:"bytes_done"`
+	CurrentFiles     []string `json:"current_files"`
+	SecondsRemaining int64    `json:"seconds_remaining"`
+
+	// summary
+	BackupSummary
+
+	// prune / forget verbose_status
+	Action string   `json:"action"`
+	Files  []string `json:"files"`
+
+	// error
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
 }
 
 func newGenericCommand(commandState *commandState) *genericCommand {
@@ -44,12 +151,67 @@ func newGenericCommand(commandState *commandState) *genericCommand {
 	}
 }
 
+// exec runs the restic subcommand described by args, deriving a timeout from
+// the environment variable registered for args[0] in subcommandTimeoutEnv
+// (no timeout if none is set).
 func (g *genericCommand) exec(args []string, options commandOptions) {
+	ctx := context.Background()
+	if len(args) > 0 {
+		if envVar, ok := subcommandTimeoutEnv[args[0]]; ok {
+			if timeout := subcommandTimeout(envVar); timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+		}
+	}
+	g.execContext(ctx, args, options)
+}
+
+// subcommandTimeout parses envVar as a Go duration (e.g. "30m"), returning 0
+// (no timeout) if it is unset or invalid.
+func subcommandTimeout(envVar string) time.Duration {
+	v := os.Getenv(envVar)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("invalid duration %q for %s: %v\n", v, envVar, err)
+		return 0
+	}
+	return d
+}
+
+// execContext runs the restic subcommand and honours ctx: on cancellation it
+// sends SIGINT so restic can finalize the current snapshot, escalating to
+// SIGKILL if restic hasn't exited after gracePeriod. ctx.Err() is exposed
+// through GetError so callers can distinguish cancellation from a genuine
+// restic failure.
+func (g *genericCommand) execContext(ctx context.Context, args []string, options commandOptions) {
+
+	// Wrap ctx so commandState.CancelAll can cancel this specific
+	// invocation (e.g. on operator-driven termination) through the exact
+	// same path as a per-subcommand timeout expiring.
+	ctx, cancel := context.WithCancel(ctx)
+	g.cancel = cancel
+	defer cancel()
+
+	if options.progress {
+		args = append(args, "--json")
+	}
+
+	if len(args) > 0 {
+		g.commandName = args[0]
+	}
+	g.repository = os.Getenv("RESTIC_REPOSITORY")
+	g.pvc = options.pvc
 
 	cmd := exec.Command(getResticBin(), args...)
 	cmd.Env = os.Environ()
 
 	g.command = cmd
+	g.startTime = time.Now()
 
 	if options.stdin {
 		stdout, stderr, err := kubernetes.PodExec(options.Params)
@@ -69,19 +231,33 @@ func (g *genericCommand) exec(args []string, options commandOptions) {
 		}
 		// This needs to run in a separate thread because
 		// cmd.CombinedOutput blocks until the command is finished
-		// TODO: this is the place where we could implement some sort of
-		// progress bars by wrapping stdin/stdout in a custom reader/writer
+		countingStdout := &countingReader{reader: stdout, cmd: g}
 		go func() {
 			defer stdin.Close()
-			_, err := io.Copy(stdin, stdout)
-			if err != nil {
-				cmd.Process.Kill()
-				fmt.Println(err)
-				g.errorMessage = err
-				stderrStr := stderr.String()
-				if stderrStr != "" {
-					fmt.Printf("Stderr of pod exec: '%v'", stderr)
-					g.errorMessage = errors.New(stderrStr)
+			copyDone := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(stdin, countingStdout)
+				copyDone <- err
+			}()
+			select {
+			case <-ctx.Done():
+				// kubernetes.PodExec has no context-aware variant, so we
+				// can't cancel the remote kubectl-exec stream itself; the
+				// best we can do locally is close our end of the pipe,
+				// which unblocks io.Copy above with a "closed pipe" error.
+				stdin.Close()
+				<-copyDone
+				return
+			case err := <-copyDone:
+				if err != nil {
+					cmd.Process.Kill()
+					fmt.Println(err)
+					g.errorMessage = err
+					stderrStr := stderr.String()
+					if stderrStr != "" {
+						fmt.Printf("Stderr of pod exec: '%v'", stderr)
+						g.errorMessage = errors.New(stderrStr)
+					}
 				}
 			}
 		}()
@@ -101,10 +277,15 @@ func (g *genericCommand) exec(args []string, options commandOptions) {
 	}
 
 	g.commandState.setRunning(g)
+	emitEvent(options.sink, Event{Type: EventCommandStarted, Command: g.commandName, Repository: g.repository})
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go g.watchContext(ctx, stopped)
 
 	go func() {
 		var collectErr error
-		stdOut, collectErr := g.collectOutput(commandStdout, options.print, options.output)
+		stdOut, collectErr := g.collectOutput(commandStdout, options.print, options.output, options.progress, options.sink)
 		finished <- collectErr
 		g.mutex.Lock()
 		g.stdOut = stdOut
@@ -113,7 +294,7 @@ func (g *genericCommand) exec(args []string, options commandOptions) {
 
 	go func() {
 		var collectErr error
-		stdErr, collectErr := g.collectOutput(commandStderr, options.print, options.output)
+		stdErr, collectErr := g.collectOutput(commandStderr, options.print, options.output, false, nil)
 		finished <- collectErr
 		g.mutex.Lock()
 		g.stdErrOut = stdErr
@@ -123,12 +304,20 @@ func (g *genericCommand) exec(args []string, options commandOptions) {
 	collectErr1 := <-finished
 	collectErr2 := <-finished
 	err = cmd.Wait()
+	g.commandState.setDone(g)
+
+	g.mutex.Lock()
+	g.endTime = time.Now()
+	if cmd.ProcessState != nil {
+		g.exitCode = cmd.ProcessState.ExitCode()
+	}
 
 	// Avoid overwriting any errors produced by the
 	// copy command
-	g.mutex.Lock()
 	if g.errorMessage == nil {
-		if err != nil {
+		if ctx.Err() != nil {
+			g.errorMessage = ctx.Err()
+		} else if err != nil {
 			g.errorMessage = err
 		}
 		if collectErr1 != nil {
@@ -138,21 +327,59 @@ func (g *genericCommand) exec(args []string, options commandOptions) {
 			g.errorMessage = collectErr2
 		}
 	}
+	finishedEvt := Event{Type: EventCommandFinished, Command: g.commandName, Repository: g.repository}
+	if g.errorMessage != nil {
+		finishedEvt.Error = g.errorMessage.Error()
+	}
 	g.mutex.Unlock()
+	emitEvent(options.sink, finishedEvt)
 }
 
-func (g *genericCommand) collectOutput(output io.Reader, print bool, out chan string) ([]string, error) {
-	collectedOutput := make([]string, 0)
+// watchContext sends SIGINT to g's process as soon as ctx is cancelled, then
+// escalates to SIGKILL if the process hasn't exited within gracePeriod. It
+// returns without doing anything once stopped is closed, i.e. once the
+// command has already finished on its own.
+func (g *genericCommand) watchContext(ctx context.Context, stopped chan struct{}) {
+	select {
+	case <-stopped:
+		return
+	case <-ctx.Done():
+	}
+
+	if err := g.sendSignal(os.Interrupt); err != nil {
+		return
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(gracePeriod):
+		g.command.Process.Kill()
+	}
+}
+
+// collectOutput reads output line by line. If sink is nil every line is
+// buffered and returned, as before. If sink is attached, lines are not
+// buffered and nil is returned, so a command with a lot of stdout (e.g.
+// `restic ls` on a large repository) doesn't grow collectedOutput without
+// bound; lines still go to print and out, and in progress mode the events
+// parsed from them go to sink.
+func (g *genericCommand) collectOutput(output io.Reader, print bool, out chan string, progress bool, sink chan<- Event) ([]string, error) {
+	var collectedOutput []string
 	scanner := bufio.NewScanner(output)
 	buff := make([]byte, 64*1024*1024)
 	scanner.Buffer(buff, 64*1024*1024)
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
 		m := scanner.Text()
+		if progress {
+			g.parseProgress(m, sink)
+		}
 		if print {
 			fmt.Println(m)
 		}
-		collectedOutput = append(collectedOutput, m)
+		if sink == nil {
+			collectedOutput = append(collectedOutput, m)
+		}
 		if out != nil {
 			out <- m
 		}
@@ -160,6 +387,79 @@ func (g *genericCommand) collectOutput(output io.Reader, print bool, out chan st
 	return collectedOutput, scanner.Err()
 }
 
+// parseProgress parses a single line of restic's --json output. Lines that
+// aren't valid JSON (e.g. restic subcommands not run in progress mode) are
+// silently ignored so this can be called unconditionally on stdout.
+func (g *genericCommand) parseProgress(line string, sink chan<- Event) {
+	var msg resticMessage
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return
+	}
+
+	g.mutex.Lock()
+
+	switch msg.MessageType {
+	case "status":
+		g.progress.PercentDone = msg.PercentDone
+		g.progress.FilesDone = msg.FilesDone
+		g.progress.TotalBytes = msg.TotalBytes
+		g.progress.BytesDone = msg.BytesDone
+		g.progress.CurrentFiles = msg.CurrentFiles
+		g.progress.ETASeconds = msg.SecondsRemaining
+		progress := g.progress
+		g.mutex.Unlock()
+
+		emitEvent(sink, Event{Type: EventProgressUpdate, Command: g.commandName, Repository: g.repository, Progress: &progress})
+		return
+	case "verbose_status":
+		// prune/forget's verbose_status packets (e.g. "remove_packs")
+		// carry no percent_done/bytes_done/total_bytes, so unlike "status"
+		// above they must never touch g.progress or it oscillates back to
+		// zero mid-run.
+		g.mutex.Unlock()
+
+		if msg.Action == "remove_packs" && len(msg.Files) > 0 {
+			emitEvent(sink, Event{Type: EventPruneRemoved, Command: g.commandName, Repository: g.repository, Removed: msg.Files})
+		}
+		return
+	case "summary":
+		summary := msg.BackupSummary
+		g.summary = &summary
+		g.mutex.Unlock()
+
+		if summary.SnapshotID != "" {
+			emitEvent(sink, Event{Type: EventSnapshotCreated, Command: g.commandName, Repository: g.repository, SnapshotID: summary.SnapshotID, Summary: &summary})
+		}
+		return
+	case "error":
+		if msg.Error != nil {
+			g.errorMessage = errors.New(msg.Error.Message)
+		}
+	}
+	g.mutex.Unlock()
+}
+
+// countingReader wraps an io.Reader and counts the bytes that have passed
+// through it, updating progress.BytesDone on every Read so the backup
+// --stdin pump reports live progress instead of a single snapshot once the
+// whole copy has finished. cmd may be nil, in which case only count is kept.
+type countingReader struct {
+	reader io.Reader
+	cmd    *genericCommand
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	if c.cmd != nil {
+		c.cmd.mutex.Lock()
+		c.cmd.progress.BytesDone = c.count
+		c.cmd.mutex.Unlock()
+	}
+	return n, err
+}
+
 // GetError returns if there was an error
 func (g *genericCommand) GetError() error { return g.errorMessage }
 
@@ -177,16 +477,118 @@ func (g *genericCommand) GetStdErrOut() []string {
 	return g.stdErrOut
 }
 
+// GetProgress returns the most recently parsed restic --json status. If the
+// command isn't running in progress mode the snapshot stays zero, except for
+// BytesDone, which countingReader updates for any --stdin command.
+func (g *genericCommand) GetProgress() ProgressSnapshot {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.progress
+}
+
 // GetWebhookData returns all objects that should get marshalled to json and
 // sent to the webhook endpoint. Returns nil by default.
 func (g *genericCommand) GetWebhookData() []output.JsonMarshaller {
-	return nil
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.summary == nil {
+		return nil
+	}
+	return []output.JsonMarshaller{g.summary}
 }
 
 // ToProm returns a list of prometheus collectors that should get pushed to
-// the prometheus push gateway.
+// the prometheus push gateway, built lazily from the data gathered by exec.
+// Returns nil if the command hasn't run yet.
 func (g *genericCommand) ToProm() []prometheus.Collector {
-	return nil
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.startTime.IsZero() {
+		return nil
+	}
+
+	// pvc is included in every label set below, even when empty, so that
+	// collectors from different invocations (e.g. concurrent BackupJobs in
+	// RunBackupPool sharing one RESTIC_REPOSITORY) never share an identical
+	// descriptor and collide when gathered together.
+	labels := prometheus.Labels{"command": g.commandName, "repository": g.repository, "pvc": g.pvc}
+
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "wrestic_command_duration_seconds",
+		Help:        "Duration of the restic command in seconds",
+		ConstLabels: labels,
+	})
+	duration.Set(g.endTime.Sub(g.startTime).Seconds())
+
+	exitCode := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "wrestic_command_exit_code",
+		Help:        "Exit code the restic command terminated with",
+		ConstLabels: labels,
+	})
+	exitCode.Set(float64(g.exitCode))
+
+	stderrLines := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "wrestic_command_stderr_lines",
+		Help:        "Number of lines the restic command wrote to stderr",
+		ConstLabels: labels,
+	})
+	stderrLines.Set(float64(len(g.stdErrOut)))
+
+	lastRun := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "wrestic_last_run_timestamp_seconds",
+		Help:        "Unix timestamp of the last command that ran against this repository/pvc; alert on max(...) by (repository)",
+		ConstLabels: labels,
+	})
+	lastRun.Set(float64(g.endTime.Unix()))
+
+	collectors := []prometheus.Collector{duration, exitCode, stderrLines, lastRun}
+
+	if g.summary != nil {
+		bytesProcessed := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "wrestic_backup_bytes_processed",
+			Help:        "Total bytes processed by the backup",
+			ConstLabels: labels,
+		})
+		bytesProcessed.Set(float64(g.summary.TotalBytesProcessed))
+
+		filesNew := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "wrestic_backup_files_new",
+			Help:        "Number of new files in the backup",
+			ConstLabels: labels,
+		})
+		filesNew.Set(float64(g.summary.FilesNew))
+
+		filesChanged := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "wrestic_backup_files_changed",
+			Help:        "Number of changed files in the backup",
+			ConstLabels: labels,
+		})
+		filesChanged.Set(float64(g.summary.FilesChanged))
+
+		filesUnmodified := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "wrestic_backup_files_unmodified",
+			Help:        "Number of unmodified files in the backup",
+			ConstLabels: labels,
+		})
+		filesUnmodified.Set(float64(g.summary.FilesUnmodified))
+
+		snapshotInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "wrestic_backup_snapshot_id_info",
+			Help: "Info metric carrying the resulting snapshot ID as a label, value is always 1",
+			ConstLabels: prometheus.Labels{
+				"command":     g.commandName,
+				"repository":  g.repository,
+				"pvc":         g.pvc,
+				"snapshot_id": g.summary.SnapshotID,
+			},
+		})
+		snapshotInfo.Set(1)
+
+		collectors = append(collectors, bytesProcessed, filesNew, filesChanged, filesUnmodified, snapshotInfo)
+	}
+
+	return collectors
 }
 
 func (g *genericCommand) sendSignal(signal os.Signal) error {
@@ -0,0 +1,189 @@
+package restic
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProgress(t *testing.T) {
+	cases := []struct {
+		name           string
+		seed           func(g *genericCommand)
+		line           string
+		wantEventTypes []EventType
+		check          func(t *testing.T, g *genericCommand)
+	}{
+		{
+			name: "non-JSON lines are ignored",
+			line: "restic 0.12.0 backing up files",
+			check: func(t *testing.T, g *genericCommand) {
+				if g.progress.PercentDone != 0 || len(g.progress.CurrentFiles) != 0 {
+					t.Errorf("progress was modified by a non-JSON line: %+v", g.progress)
+				}
+			},
+		},
+		{
+			name:           "status updates progress and emits ProgressUpdate",
+			line:           `{"message_type":"status","percent_done":0.5,"files_done":3,"total_bytes":100,"bytes_done":50,"current_files":["a.txt"],"seconds_remaining":10}`,
+			wantEventTypes: []EventType{EventProgressUpdate},
+			check: func(t *testing.T, g *genericCommand) {
+				want := ProgressSnapshot{PercentDone: 0.5, FilesDone: 3, TotalBytes: 100, BytesDone: 50, CurrentFiles: []string{"a.txt"}, ETASeconds: 10}
+				if !reflect.DeepEqual(g.progress, want) {
+					t.Errorf("progress = %+v, want %+v", g.progress, want)
+				}
+			},
+		},
+		{
+			name:           "summary populates BackupSummary and emits SnapshotCreated",
+			line:           `{"message_type":"summary","files_new":1,"files_changed":2,"files_unmodified":3,"data_added":10,"total_files_processed":6,"total_bytes_processed":1000,"snapshot_id":"abc123"}`,
+			wantEventTypes: []EventType{EventSnapshotCreated},
+			check: func(t *testing.T, g *genericCommand) {
+				if g.summary == nil || g.summary.SnapshotID != "abc123" || g.summary.FilesNew != 1 {
+					t.Errorf("summary = %+v, want snapshot_id abc123 with files_new 1", g.summary)
+				}
+			},
+		},
+		{
+			name: "summary without a snapshot ID emits no event",
+			line: `{"message_type":"summary","files_new":1}`,
+			check: func(t *testing.T, g *genericCommand) {
+				if g.summary == nil || g.summary.SnapshotID != "" {
+					t.Errorf("summary = %+v, want empty snapshot_id", g.summary)
+				}
+			},
+		},
+		{
+			name: "error sets errorMessage and emits no event",
+			line: `{"message_type":"error","error":{"message":"repository locked"}}`,
+			check: func(t *testing.T, g *genericCommand) {
+				if g.errorMessage == nil || g.errorMessage.Error() != "repository locked" {
+					t.Errorf("errorMessage = %v, want %q", g.errorMessage, "repository locked")
+				}
+			},
+		},
+		{
+			name:           "prune remove_packs emits PruneRemoved without touching progress",
+			line:           `{"message_type":"verbose_status","action":"remove_packs","files":["pack1","pack2"]}`,
+			wantEventTypes: []EventType{EventPruneRemoved},
+			check: func(t *testing.T, g *genericCommand) {
+				if g.progress.PercentDone != 0 || g.progress.BytesDone != 0 || len(g.progress.CurrentFiles) != 0 {
+					t.Errorf("verbose_status modified progress: %+v", g.progress)
+				}
+			},
+		},
+		{
+			name: "verbose_status without remove_packs emits no event",
+			line: `{"message_type":"verbose_status","action":"scan"}`,
+		},
+		{
+			name: "a prior status is not zeroed by a later verbose_status",
+			seed: func(g *genericCommand) {
+				g.progress = ProgressSnapshot{PercentDone: 0.75, BytesDone: 42}
+			},
+			line:           `{"message_type":"verbose_status","action":"remove_packs","files":["pack1"]}`,
+			wantEventTypes: []EventType{EventPruneRemoved},
+			check: func(t *testing.T, g *genericCommand) {
+				want := ProgressSnapshot{PercentDone: 0.75, BytesDone: 42}
+				if !reflect.DeepEqual(g.progress, want) {
+					t.Errorf("progress = %+v, want %+v (verbose_status must not touch it)", g.progress, want)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newGenericCommand(newCommandState())
+			if tc.seed != nil {
+				tc.seed(g)
+			}
+			sink := make(chan Event, len(tc.wantEventTypes)+1)
+
+			g.parseProgress(tc.line, sink)
+			close(sink)
+
+			var got []EventType
+			for evt := range sink {
+				got = append(got, evt.Type)
+			}
+			if !reflect.DeepEqual(got, tc.wantEventTypes) {
+				t.Errorf("emitted event types = %v, want %v", got, tc.wantEventTypes)
+			}
+			if tc.check != nil {
+				tc.check(t, g)
+			}
+		})
+	}
+}
+
+func TestCountingReaderUpdatesProgressLive(t *testing.T) {
+	g := newGenericCommand(newCommandState())
+	r := &countingReader{reader: strings.NewReader("hello world"), cmd: g}
+
+	buf := make([]byte, 5)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if got := g.GetProgress().BytesDone; got != int64(n) {
+		t.Errorf("BytesDone after first Read = %d, want %d (must update live, not only once the whole copy finishes)", got, n)
+	}
+
+	n2, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if want := int64(n + n2); g.GetProgress().BytesDone != want {
+		t.Errorf("BytesDone after second Read = %d, want %d", g.GetProgress().BytesDone, want)
+	}
+}
+
+func TestSubcommandTimeout(t *testing.T) {
+	cases := []struct {
+		name string
+		env  string
+		want time.Duration
+	}{
+		{"unset means no timeout", "", 0},
+		{"valid duration is honoured", "30m", 30 * time.Minute},
+		{"invalid duration falls back to no timeout", "nope", 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WRESTIC_TEST_TIMEOUT", tc.env)
+			if got := subcommandTimeout("WRESTIC_TEST_TIMEOUT"); got != tc.want {
+				t.Errorf("subcommandTimeout() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCollectOutputBuffering(t *testing.T) {
+	g := newGenericCommand(newCommandState())
+
+	t.Run("buffers stdout when no sink is attached", func(t *testing.T) {
+		out, err := g.collectOutput(strings.NewReader("a\nb\nc\n"), false, nil, false, nil)
+		if err != nil {
+			t.Fatalf("collectOutput() error = %v", err)
+		}
+		want := []string{"a", "b", "c"}
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("collectOutput() = %v, want %v", out, want)
+		}
+	})
+
+	t.Run("does not buffer stdout once a sink is attached", func(t *testing.T) {
+		sink := make(chan Event)
+		close(sink)
+		out, err := g.collectOutput(strings.NewReader("a\nb\nc\n"), false, nil, false, sink)
+		if err != nil {
+			t.Fatalf("collectOutput() error = %v", err)
+		}
+		if out != nil {
+			t.Errorf("collectOutput() = %v, want nil (no buffering once a sink is attached)", out)
+		}
+	})
+}